@@ -1,14 +1,23 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"regexp"
 	"strings"
 	"time"
 
-	"github.com/crowdmob/goamz/aws"
-	"github.com/crowdmob/goamz/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 )
 
@@ -18,12 +27,65 @@ const (
 	metricsTypeSum     = "Sum"
 	metricsTypeMaximum = "Maximum"
 	metricsTypeMinimum = "Minimum"
+
+	metricsPeriod = 60
+
+	// maxMetricDataQueriesPerRequest is CloudWatch's cap on the number of
+	// MetricDataQueries entries accepted by a single GetMetricData call.
+	maxMetricDataQueriesPerRequest = 500
 )
 
 type metrics struct {
 	CloudWatchName string
 	MackerelName   string
 	Type           string
+
+	// Graph is the streamMetricGraphs dict key this metric is drawn on. In
+	// multi-stream mode it's also the leading path segment of the stat map
+	// key built for it (see buildStreamMetricDataQueries), so that segment
+	// always matches the graph it's wildcarded under.
+	Graph string
+}
+
+// streamMetrics are the stream-level CloudWatch metrics collected on every run.
+var streamMetrics = [...]metrics{
+	{CloudWatchName: "GetRecords.Bytes", MackerelName: "GetRecordsBytes", Type: metricsTypeAverage, Graph: "bytes"},
+	{CloudWatchName: "GetRecords.IteratorAgeMilliseconds", MackerelName: "GetRecordsDelayMaxMilliseconds", Type: metricsTypeMaximum, Graph: "iteratorage"},
+	{CloudWatchName: "GetRecords.IteratorAgeMilliseconds", MackerelName: "GetRecordsDelayMinMilliseconds", Type: metricsTypeMinimum, Graph: "iteratorage"},
+	{CloudWatchName: "GetRecords.Latency", MackerelName: "GetRecordsLatency", Type: metricsTypeAverage, Graph: "latency"},
+	{CloudWatchName: "GetRecords.Records", MackerelName: "GetRecordsRecords", Type: metricsTypeAverage, Graph: "records"},
+	{CloudWatchName: "GetRecords.Success", MackerelName: "GetRecordsSuccess", Type: metricsTypeAverage, Graph: "success"},
+	{CloudWatchName: "IncomingBytes", MackerelName: "IncomingBytes", Type: metricsTypeAverage, Graph: "bytes"},
+	{CloudWatchName: "IncomingRecords", MackerelName: "IncomingRecords", Type: metricsTypeAverage, Graph: "records"},
+	{CloudWatchName: "PutRecord.Bytes", MackerelName: "PutRecordBytes", Type: metricsTypeAverage, Graph: "bytes"},
+	{CloudWatchName: "PutRecord.Latency", MackerelName: "PutRecordLatency", Type: metricsTypeAverage, Graph: "latency"},
+	{CloudWatchName: "PutRecord.Success", MackerelName: "PutRecordSuccess", Type: metricsTypeAverage, Graph: "success"},
+	{CloudWatchName: "PutRecords.Bytes", MackerelName: "PutRecordsBytes", Type: metricsTypeAverage, Graph: "bytes"},
+	{CloudWatchName: "PutRecords.Latency", MackerelName: "PutRecordsLatency", Type: metricsTypeAverage, Graph: "latency"},
+	{CloudWatchName: "PutRecords.Records", MackerelName: "PutRecordsRecords", Type: metricsTypeAverage, Graph: "records"},
+	{CloudWatchName: "PutRecords.Success", MackerelName: "PutRecordsSuccess", Type: metricsTypeAverage, Graph: "success"},
+	{CloudWatchName: "ReadProvisionedThroughputExceeded", MackerelName: "ReadThroughputExceeded", Type: metricsTypeAverage, Graph: "pending"},
+	{CloudWatchName: "WriteProvisionedThroughputExceeded", MackerelName: "WriteThroughputExceeded", Type: metricsTypeAverage, Graph: "pending"},
+}
+
+// shardMetrics are the per-shard CloudWatch metrics collected when
+// -enable-shard-metrics is set, broken down by the ShardId dimension.
+var shardMetrics = [...]metrics{
+	{CloudWatchName: "IncomingBytes", MackerelName: "IncomingBytes", Type: metricsTypeAverage},
+	{CloudWatchName: "IncomingRecords", MackerelName: "IncomingRecords", Type: metricsTypeAverage},
+	{CloudWatchName: "IteratorAgeMilliseconds", MackerelName: "IteratorAgeMilliseconds", Type: metricsTypeMaximum},
+	{CloudWatchName: "ReadProvisionedThroughputExceeded", MackerelName: "ReadProvisionedThroughputExceeded", Type: metricsTypeAverage},
+	{CloudWatchName: "WriteProvisionedThroughputExceeded", MackerelName: "WriteProvisionedThroughputExceeded", Type: metricsTypeAverage},
+}
+
+// efoMetrics are the Kinesis Enhanced Fan-Out consumer metrics collected
+// when -enable-efo-metrics is set, broken down by the ConsumerName dimension.
+var efoMetrics = [...]metrics{
+	{CloudWatchName: "SubscribeToShard.RateExceeded", MackerelName: "SubscribeToShardRateExceeded", Type: metricsTypeSum},
+	{CloudWatchName: "SubscribeToShard.Success", MackerelName: "SubscribeToShardSuccess", Type: metricsTypeSum},
+	{CloudWatchName: "SubscribeToShardEvent.Bytes", MackerelName: "SubscribeToShardEventBytes", Type: metricsTypeSum},
+	{CloudWatchName: "SubscribeToShardEvent.Records", MackerelName: "SubscribeToShardEventRecords", Type: metricsTypeSum},
+	{CloudWatchName: "SubscribeToShardEvent.MillisBehindLatest", MackerelName: "SubscribeToShardEventMillisBehindLatest", Type: metricsTypeMaximum},
 }
 
 // KinesisStreamsPlugin mackerel plugin for aws kinesis
@@ -34,7 +96,26 @@ type KinesisStreamsPlugin struct {
 	AccessKeyID     string
 	SecretAccessKey string
 	Region          string
-	CloudWatch      *cloudwatch.CloudWatch
+	Profile         string
+	RoleARN         string
+	ExternalID      string
+	Endpoint        string
+	CloudWatch      *cloudwatch.Client
+	Kinesis         *kinesis.Client
+
+	EnableShardMetrics bool
+	EnableEFOMetrics   bool
+
+	// StreamNamePattern and StreamTag select which streams are monitored
+	// when Name is empty (multi-stream mode).
+	StreamNamePattern string
+	StreamTag         string
+}
+
+// multiStream reports whether the plugin monitors every stream in the
+// region instead of a single named one.
+func (p KinesisStreamsPlugin) multiStream() bool {
+	return p.Name == ""
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -45,166 +126,543 @@ func (p KinesisStreamsPlugin) MetricKeyPrefix() string {
 	return p.Prefix
 }
 
-// prepare creates CloudWatch instance
+// prepare creates the CloudWatch and Kinesis clients, resolving credentials in the
+// documented order: explicit -access-key-id/-secret-access-key flags, then
+// the SDK's default chain (env vars, shared credentials file, EC2/ECS
+// instance profile via IMDSv2), optionally wrapped in an AssumeRole call
+// when -role-arn is given.
 func (p *KinesisStreamsPlugin) prepare() error {
-	auth, err := aws.GetAuth(p.AccessKeyID, p.SecretAccessKey, "", time.Now())
-	if err != nil {
-		return err
+	ctx := context.Background()
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if p.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(p.Region))
+	}
+	if p.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(p.Profile))
+	}
+	if p.AccessKeyID != "" || p.SecretAccessKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(p.AccessKeyID, p.SecretAccessKey, ""),
+		))
 	}
 
-	p.CloudWatch, err = cloudwatch.NewCloudWatch(auth, aws.Regions[p.Region].CloudWatchServicepoint)
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
 	if err != nil {
 		return err
 	}
 
+	if p.RoleARN != "" {
+		stsClient := sts.NewFromConfig(cfg)
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsClient, p.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			if p.ExternalID != "" {
+				o.ExternalID = aws.String(p.ExternalID)
+			}
+		}))
+	}
+
+	p.CloudWatch = cloudwatch.NewFromConfig(cfg, func(o *cloudwatch.Options) {
+		if p.Endpoint != "" {
+			o.BaseEndpoint = aws.String(p.Endpoint)
+		}
+	})
+
+	p.Kinesis = kinesis.NewFromConfig(cfg, func(o *kinesis.Options) {
+		if p.Endpoint != "" {
+			o.BaseEndpoint = aws.String(p.Endpoint)
+		}
+	})
+
 	return nil
 }
 
-// getLastPoint fetches a CloudWatch metric and parse
-func (p KinesisStreamsPlugin) getLastPoint(metric metrics) (float64, error) {
-	now := time.Now()
+// metricDataQuery pairs a MetricDataQuery sent to CloudWatch with the
+// mackerel metric name its result should be stored under.
+type metricDataQuery struct {
+	query     types.MetricDataQuery
+	outputKey string
+}
 
-	dimensions := []cloudwatch.Dimension{
-		{
-			Name:  "StreamName",
-			Value: p.Name,
+func newMetricDataQuery(id string, met metrics, dimensions []types.Dimension, outputKey string) metricDataQuery {
+	return metricDataQuery{
+		query: types.MetricDataQuery{
+			Id: aws.String(id),
+			MetricStat: &types.MetricStat{
+				Metric: &types.Metric{
+					Namespace:  aws.String(namespace),
+					MetricName: aws.String(met.CloudWatchName),
+					Dimensions: dimensions,
+				},
+				Period: aws.Int32(metricsPeriod),
+				Stat:   aws.String(met.Type),
+			},
+			ReturnData: aws.Bool(true),
 		},
+		outputKey: outputKey,
+	}
+}
+
+// listShardIDs discovers the currently open shards of the stream via
+// Kinesis's own ListShards API rather than from the ShardId dimension values
+// in CloudWatch's ListMetrics, which only surfaces shards that have recently
+// emitted a datapoint - missing brand-new or idle shards and lingering on
+// recently-closed ones.
+func (p KinesisStreamsPlugin) listShardIDs(ctx context.Context, streamName string) ([]string, error) {
+	var shardIDs []string
+
+	input := &kinesis.ListShardsInput{
+		StreamName:  aws.String(streamName),
+		ShardFilter: &kinesistypes.ShardFilter{Type: kinesistypes.ShardFilterTypeAtLatest},
+	}
+
+	for {
+		resp, err := p.Kinesis.ListShards(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, shard := range resp.Shards {
+			shardIDs = append(shardIDs, aws.ToString(shard.ShardId))
+		}
+
+		if resp.NextToken == nil {
+			break
+		}
+		// ListShards forbids combining NextToken with StreamName/ShardFilter.
+		input = &kinesis.ListShardsInput{NextToken: resp.NextToken}
 	}
 
-	response, err := p.CloudWatch.GetMetricStatistics(&cloudwatch.GetMetricStatisticsRequest{
-		Dimensions: dimensions,
-		StartTime:  now.Add(time.Duration(180) * time.Second * -1), // 3 min
-		EndTime:    now,
-		MetricName: metric.CloudWatchName,
-		Period:     60,
-		Statistics: []string{metric.Type},
-		Namespace:  namespace,
+	return shardIDs, nil
+}
+
+// listConsumerNames discovers the enhanced fan-out consumers currently
+// registered against the stream, so their metrics can be broken down by
+// ConsumerName.
+func (p KinesisStreamsPlugin) listConsumerNames(ctx context.Context, streamName string) ([]string, error) {
+	streamDesc, err := p.Kinesis.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(streamName),
 	})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	streamARN := streamDesc.StreamDescriptionSummary.StreamARN
+
+	var consumerNames []string
+	input := &kinesis.ListStreamConsumersInput{StreamARN: streamARN}
+	for {
+		resp, err := p.Kinesis.ListStreamConsumers(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, consumer := range resp.Consumers {
+			consumerNames = append(consumerNames, aws.ToString(consumer.ConsumerName))
+		}
 
-	datapoints := response.GetMetricStatisticsResult.Datapoints
-	if len(datapoints) == 0 {
-		return 0, errors.New("fetched no datapoints")
+		if resp.NextToken == nil {
+			break
+		}
+		input.NextToken = resp.NextToken
 	}
 
-	latest := time.Unix(0, 0)
-	var latestVal float64
-	for _, dp := range datapoints {
-		if dp.Timestamp.Before(latest) {
-			continue
+	return consumerNames, nil
+}
+
+// listTargetStreamNames returns the streams to be monitored this cycle: just
+// Name if it's set, otherwise every stream in the region matching
+// -stream-name-pattern and -stream-tag.
+func (p KinesisStreamsPlugin) listTargetStreamNames(ctx context.Context) ([]string, error) {
+	if p.Name != "" {
+		return []string{p.Name}, nil
+	}
+
+	var namePattern *regexp.Regexp
+	if p.StreamNamePattern != "" {
+		re, err := regexp.Compile(p.StreamNamePattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -stream-name-pattern: %s", err)
+		}
+		namePattern = re
+	}
+
+	var tagKey, tagValue string
+	if p.StreamTag != "" {
+		kv := strings.SplitN(p.StreamTag, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid -stream-tag %q, expected key=value", p.StreamTag)
+		}
+		tagKey, tagValue = kv[0], kv[1]
+	}
+
+	var names []string
+	input := &kinesis.ListStreamsInput{}
+	for {
+		resp, err := p.Kinesis.ListStreams(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range resp.StreamNames {
+			if namePattern != nil && !namePattern.MatchString(name) {
+				continue
+			}
+			if tagKey != "" {
+				ok, err := p.streamHasTag(ctx, name, tagKey, tagValue)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			names = append(names, name)
+		}
+
+		if !aws.ToBool(resp.HasMoreStreams) || len(resp.StreamNames) == 0 {
+			break
+		}
+		input.ExclusiveStartStreamName = aws.String(resp.StreamNames[len(resp.StreamNames)-1])
+	}
+
+	return names, nil
+}
+
+// streamHasTag reports whether streamName is tagged with key=value.
+func (p KinesisStreamsPlugin) streamHasTag(ctx context.Context, streamName, key, value string) (bool, error) {
+	resp, err := p.Kinesis.ListTagsForStream(ctx, &kinesis.ListTagsForStreamInput{
+		StreamName: aws.String(streamName),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, tag := range resp.Tags {
+		if aws.ToString(tag.Key) == key && aws.ToString(tag.Value) == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sanitizeMetricKeySegment makes s safe to use as a single "."-delimited
+// path segment of a wildcarded stat map key. AWS allows "." in Kinesis
+// stream and consumer names, but the mackerel-plugin-helper wildcard
+// regexp replaces "#" with a char class that excludes "." - a literal dot
+// in the name would silently split it across two path segments and the
+// metric would never match. Replace it with "_" instead of rejecting the
+// name outright, so the stream/consumer is still monitored.
+func sanitizeMetricKeySegment(s string) string {
+	return strings.Replace(s, ".", "_", -1)
+}
+
+// buildStreamMetricDataQueries assembles the MetricDataQueries for a single
+// stream. streamIdx keeps query ids unique across streams when several are
+// batched into one GetMetricData call.
+func (p KinesisStreamsPlugin) buildStreamMetricDataQueries(ctx context.Context, streamIdx int, streamName string) ([]metricDataQuery, error) {
+	multiStream := p.multiStream()
+	// Stream names, like consumer names, may contain literal dots; see
+	// sanitizeMetricKeySegment. Only used in the stat key, never in the
+	// CloudWatch dimension value.
+	streamKey := sanitizeMetricKeySegment(streamName)
+
+	streamDims := []types.Dimension{
+		{Name: aws.String("StreamName"), Value: aws.String(streamName)},
+	}
+
+	queries := make([]metricDataQuery, 0, len(streamMetrics))
+	for i, met := range streamMetrics {
+		id := fmt.Sprintf("t%d_s%d", streamIdx, i)
+		outputKey := met.MackerelName
+		if multiStream {
+			// met.Graph must lead so this key's first path segment always
+			// matches the streamMetricGraphs dict key it's wildcarded under.
+			outputKey = fmt.Sprintf("%s.%s.%s", met.Graph, streamKey, met.MackerelName)
 		}
+		queries = append(queries, newMetricDataQuery(id, met, streamDims, outputKey))
+	}
+
+	if p.EnableShardMetrics {
+		shardIDs, err := p.listShardIDs(ctx, streamName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shards for stream %s: %s", streamName, err)
+		}
+
+		for i, shardID := range shardIDs {
+			dims := append(append([]types.Dimension{}, streamDims...), types.Dimension{Name: aws.String("ShardId"), Value: aws.String(shardID)})
+			for j, met := range shardMetrics {
+				id := fmt.Sprintf("t%d_d%d_%d", streamIdx, i, j)
+				outputKey := fmt.Sprintf("shards.%s.%s", shardID, met.MackerelName)
+				if multiStream {
+					outputKey = fmt.Sprintf("shards.%s.%s.%s", streamKey, shardID, met.MackerelName)
+				}
+				queries = append(queries, newMetricDataQuery(id, met, dims, outputKey))
+			}
+		}
+	}
+
+	if p.EnableEFOMetrics {
+		consumerNames, err := p.listConsumerNames(ctx, streamName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list stream consumers for stream %s: %s", streamName, err)
+		}
+
+		for i, consumerName := range consumerNames {
+			dims := append(append([]types.Dimension{}, streamDims...), types.Dimension{Name: aws.String("ConsumerName"), Value: aws.String(consumerName)})
+			consumerKey := sanitizeMetricKeySegment(consumerName)
+			for j, met := range efoMetrics {
+				id := fmt.Sprintf("t%d_e%d_%d", streamIdx, i, j)
+				outputKey := fmt.Sprintf("efo.%s.%s", consumerKey, met.MackerelName)
+				if multiStream {
+					outputKey = fmt.Sprintf("efo.%s.%s.%s", streamKey, consumerKey, met.MackerelName)
+				}
+				queries = append(queries, newMetricDataQuery(id, met, dims, outputKey))
+			}
+		}
+	}
+
+	return queries, nil
+}
 
-		latest = dp.Timestamp
-		switch metric.Type {
-		case metricsTypeAverage:
-			latestVal = dp.Average
-		case metricsTypeSum:
-			latestVal = dp.Sum
-		case metricsTypeMaximum:
-			latestVal = dp.Maximum
-		case metricsTypeMinimum:
-			latestVal = dp.Minimum
+// buildMetricDataQueries assembles every MetricDataQuery needed for one
+// collection cycle, across every target stream, so FetchMetrics can
+// retrieve them in one GetMetricData call per maxMetricDataQueriesPerRequest
+// queries.
+func (p KinesisStreamsPlugin) buildMetricDataQueries(ctx context.Context) ([]metricDataQuery, error) {
+	streamNames, err := p.listTargetStreamNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list streams: %s", err)
+	}
+
+	var queries []metricDataQuery
+	for streamIdx, streamName := range streamNames {
+		streamQueries, err := p.buildStreamMetricDataQueries(ctx, streamIdx, streamName)
+		if err != nil {
+			return nil, err
 		}
+		queries = append(queries, streamQueries...)
 	}
 
-	return latestVal, nil
+	return queries, nil
+}
+
+// latestValue picks the value for the most recent timestamp in a
+// GetMetricData result; CloudWatch usually returns points newest-first but
+// that ordering isn't guaranteed.
+func latestValue(result types.MetricDataResult) float64 {
+	latest := time.Unix(0, 0)
+	var latestVal float64
+	for i, ts := range result.Timestamps {
+		if ts.Before(latest) {
+			continue
+		}
+		latest = ts
+		latestVal = result.Values[i]
+	}
+	return latestVal
 }
 
 // FetchMetrics fetch the metrics
 func (p KinesisStreamsPlugin) FetchMetrics() (map[string]interface{}, error) {
+	ctx := context.Background()
+
+	queries, err := p.buildMetricDataQueries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	startTime := aws.Time(now.Add(time.Duration(180) * time.Second * -1)) // 3 min
+	endTime := aws.Time(now)
+
+	outputKeyByID := make(map[string]string, len(queries))
+	for _, q := range queries {
+		outputKeyByID[aws.ToString(q.query.Id)] = q.outputKey
+	}
+
 	stat := make(map[string]interface{})
+	for _, batch := range chunkMetricDataQueries(queries, maxMetricDataQueriesPerRequest) {
+		input := &cloudwatch.GetMetricDataInput{
+			StartTime: startTime,
+			EndTime:   endTime,
+		}
+		for _, q := range batch {
+			input.MetricDataQueries = append(input.MetricDataQueries, q.query)
+		}
+
+		resp, err := p.CloudWatch.GetMetricData(ctx, input)
+		if err != nil {
+			return nil, err
+		}
 
-	for _, met := range [...]metrics{
-		{CloudWatchName: "GetRecords.Bytes", MackerelName: "GetRecordsBytes", Type: metricsTypeAverage},
-		{CloudWatchName: "GetRecords.IteratorAgeMilliseconds", MackerelName: "GetRecordsDelayMaxMilliseconds", Type: metricsTypeMaximum},
-		{CloudWatchName: "GetRecords.IteratorAgeMilliseconds", MackerelName: "GetRecordsDelayMinMilliseconds", Type: metricsTypeMinimum},
-		{CloudWatchName: "GetRecords.Latency", MackerelName: "GetRecordsLatency", Type: metricsTypeAverage},
-		{CloudWatchName: "GetRecords.Records", MackerelName: "GetRecordsRecords", Type: metricsTypeAverage},
-		{CloudWatchName: "GetRecords.Success", MackerelName: "GetRecordsSuccess", Type: metricsTypeAverage},
-		{CloudWatchName: "IncomingBytes", MackerelName: "IncomingBytes", Type: metricsTypeAverage},
-		{CloudWatchName: "IncomingRecords", MackerelName: "IncomingRecords", Type: metricsTypeAverage},
-		{CloudWatchName: "PutRecord.Bytes", MackerelName: "PutRecordBytes", Type: metricsTypeAverage},
-		{CloudWatchName: "PutRecord.Latency", MackerelName: "PutRecordLatency", Type: metricsTypeAverage},
-		{CloudWatchName: "PutRecord.Success", MackerelName: "PutRecordSuccess", Type: metricsTypeAverage},
-		{CloudWatchName: "PutRecords.Bytes", MackerelName: "PutRecordsBytes", Type: metricsTypeAverage},
-		{CloudWatchName: "PutRecords.Latency", MackerelName: "PutRecordsLatency", Type: metricsTypeAverage},
-		{CloudWatchName: "PutRecords.Records", MackerelName: "PutRecordsRecords", Type: metricsTypeAverage},
-		{CloudWatchName: "PutRecords.Success", MackerelName: "PutRecordsSuccess", Type: metricsTypeAverage},
-		{CloudWatchName: "ReadProvidionedThroughputExceeded", MackerelName: "ReadThroughputExceeded", Type: metricsTypeAverage},
-		{CloudWatchName: "WriteProvidionedThroughputExceeded", MackerelName: "WriteThroughputExceeded", Type: metricsTypeAverage},
-	} {
-		v, err := p.getLastPoint(met)
-		if err == nil {
-			stat[met.MackerelName] = v
-		} else {
-			log.Printf("%s: %s", met, err)
+		for _, result := range resp.MetricDataResults {
+			outputKey, ok := outputKeyByID[aws.ToString(result.Id)]
+			if !ok {
+				continue
+			}
+			if len(result.Values) == 0 {
+				log.Printf("%s: fetched no datapoints", outputKey)
+				continue
+			}
+			stat[outputKey] = latestValue(result)
 		}
 	}
+
 	return stat, nil
 }
 
-// GraphDefinition of KinesisStreamsPlugin
-func (p KinesisStreamsPlugin) GraphDefinition() map[string]mp.Graphs {
-	labelPrefix := strings.Title(p.Prefix)
-	labelPrefix = strings.Replace(labelPrefix, "-", " ", -1)
+// chunkMetricDataQueries splits queries into batches of at most size entries,
+// so FetchMetrics stays under CloudWatch's per-call MetricDataQueries limit.
+func chunkMetricDataQueries(queries []metricDataQuery, size int) [][]metricDataQuery {
+	var batches [][]metricDataQuery
+	for len(queries) > 0 {
+		n := size
+		if n > len(queries) {
+			n = len(queries)
+		}
+		batches = append(batches, queries[:n])
+		queries = queries[n:]
+	}
+	return batches
+}
+
+// streamMetricGraphs builds the core per-stream graph groups. In
+// multi-stream mode, buildStreamMetricDataQueries prefixes each stat key
+// with its graph dict key followed by the stream name, so Metrics.Name
+// needs a single "#." wildcard segment to match it; in single-stream mode
+// the stat key is the flat MackerelName and needs no wildcard at all.
+func streamMetricGraphs(labelPrefix string, multiStream bool) map[string]mp.Graphs {
+	keyPrefix := ""
+	if multiStream {
+		keyPrefix = "#."
+	}
 
-	var graphdef = map[string]mp.Graphs{
+	return map[string]mp.Graphs{
 		"bytes": mp.Graphs{
 			Label: (labelPrefix + " Bytes"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
-				mp.Metrics{Name: "GetRecordsBytes", Label: "GetRecords"},
-				mp.Metrics{Name: "IncomingBytes", Label: "Total Incoming"},
-				mp.Metrics{Name: "PutRecordBytes", Label: "PutRecord"},
-				mp.Metrics{Name: "PutRecordsBytes", Label: "PutRecords"},
+				mp.Metrics{Name: keyPrefix + "GetRecordsBytes", Label: "GetRecords"},
+				mp.Metrics{Name: keyPrefix + "IncomingBytes", Label: "Total Incoming"},
+				mp.Metrics{Name: keyPrefix + "PutRecordBytes", Label: "PutRecord"},
+				mp.Metrics{Name: keyPrefix + "PutRecordsBytes", Label: "PutRecords"},
 			},
 		},
 		"iteratorage": mp.Graphs{
 			Label: (labelPrefix + " Read Delay"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
-				mp.Metrics{Name: "GetRecordsDelayMaxMilliseconds", Label: "Max"},
-				mp.Metrics{Name: "GetRecordsDelayMinMilliseconds", Label: "min"},
+				mp.Metrics{Name: keyPrefix + "GetRecordsDelayMaxMilliseconds", Label: "Max"},
+				mp.Metrics{Name: keyPrefix + "GetRecordsDelayMinMilliseconds", Label: "min"},
 			},
 		},
 		"latency": mp.Graphs{
 			Label: (labelPrefix + " Operation Latency"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
-				mp.Metrics{Name: "GetRecordsLatency", Label: "GetRecords"},
-				mp.Metrics{Name: "PutRecordLatency", Label: "PutRecord"},
-				mp.Metrics{Name: "PutRecordsLatency", Label: "PutRecords"},
+				mp.Metrics{Name: keyPrefix + "GetRecordsLatency", Label: "GetRecords"},
+				mp.Metrics{Name: keyPrefix + "PutRecordLatency", Label: "PutRecord"},
+				mp.Metrics{Name: keyPrefix + "PutRecordsLatency", Label: "PutRecords"},
 			},
 		},
 		"records": mp.Graphs{
 			Label: (labelPrefix + " Records"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
-				mp.Metrics{Name: "GetRecordsRecords", Label: "GetRecords"},
-				mp.Metrics{Name: "IncomingRecords", Label: "Total Incoming"},
-				mp.Metrics{Name: "PutRecordsRecords", Label: "PutRecords"},
+				mp.Metrics{Name: keyPrefix + "GetRecordsRecords", Label: "GetRecords"},
+				mp.Metrics{Name: keyPrefix + "IncomingRecords", Label: "Total Incoming"},
+				mp.Metrics{Name: keyPrefix + "PutRecordsRecords", Label: "PutRecords"},
 			},
 		},
 		"success": mp.Graphs{
 			Label: (labelPrefix + " Operation Success"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
-				mp.Metrics{Name: "GetRecordsSuccess", Label: "GetRecords"},
-				mp.Metrics{Name: "PutRecordSuccess", Label: "PutRecord"},
-				mp.Metrics{Name: "PutRecordsSuccess", Label: "PutRecords"},
+				mp.Metrics{Name: keyPrefix + "GetRecordsSuccess", Label: "GetRecords"},
+				mp.Metrics{Name: keyPrefix + "PutRecordSuccess", Label: "PutRecord"},
+				mp.Metrics{Name: keyPrefix + "PutRecordsSuccess", Label: "PutRecords"},
 			},
 		},
 		"pending": mp.Graphs{
 			Label: (labelPrefix + " Pending Operations"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
-				mp.Metrics{Name: "ReadThroughputExceeded", Label: "Read"},
-				mp.Metrics{Name: "WriteThroughputExceeded", Label: "Write"},
+				mp.Metrics{Name: keyPrefix + "ReadThroughputExceeded", Label: "Read"},
+				mp.Metrics{Name: keyPrefix + "WriteThroughputExceeded", Label: "Write"},
 			},
 		},
 	}
+}
+
+// shardMetricGraphs builds the per-shard graph group, wildcarded by ShardId
+// (and additionally by stream name in multi-stream mode, matching the
+// "shards.<streamName>.<shardID>." stat keys buildStreamMetricDataQueries
+// builds in that case).
+//
+// The mackerel-plugin-helper matches wildcarded metrics by building
+// "<graph dict key>." + Metrics.Name as a regexp, so Metrics.Name must not
+// repeat the "shards" dict key itself - only the wildcard segment(s) below it.
+func shardMetricGraphs(labelPrefix string, multiStream bool) mp.Graphs {
+	keyPrefix := "#."
+	if multiStream {
+		keyPrefix = "#.#."
+	}
+
+	return mp.Graphs{
+		Label: (labelPrefix + " Shards"),
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			mp.Metrics{Name: keyPrefix + "IncomingBytes", Label: "Incoming Bytes"},
+			mp.Metrics{Name: keyPrefix + "IncomingRecords", Label: "Incoming Records"},
+			mp.Metrics{Name: keyPrefix + "IteratorAgeMilliseconds", Label: "Iterator Age (ms)"},
+			mp.Metrics{Name: keyPrefix + "ReadProvisionedThroughputExceeded", Label: "Read Throughput Exceeded"},
+			mp.Metrics{Name: keyPrefix + "WriteProvisionedThroughputExceeded", Label: "Write Throughput Exceeded"},
+		},
+	}
+}
+
+// efoMetricGraphs builds the Enhanced Fan-Out graph group, wildcarded by
+// ConsumerName (and additionally by stream name in multi-stream mode,
+// matching the "efo.<streamName>.<consumerName>." stat keys
+// buildStreamMetricDataQueries builds in that case).
+//
+// As with shardMetricGraphs, Metrics.Name must not repeat the "efo" dict
+// key - the helper already prepends it when building the wildcard regexp.
+func efoMetricGraphs(labelPrefix string, multiStream bool) mp.Graphs {
+	keyPrefix := "#."
+	if multiStream {
+		keyPrefix = "#.#."
+	}
+
+	return mp.Graphs{
+		Label: (labelPrefix + " Enhanced Fan-Out Consumers"),
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			mp.Metrics{Name: keyPrefix + "SubscribeToShardRateExceeded", Label: "SubscribeToShard Rate Exceeded"},
+			mp.Metrics{Name: keyPrefix + "SubscribeToShardSuccess", Label: "SubscribeToShard Success"},
+			mp.Metrics{Name: keyPrefix + "SubscribeToShardEventBytes", Label: "SubscribeToShardEvent Bytes"},
+			mp.Metrics{Name: keyPrefix + "SubscribeToShardEventRecords", Label: "SubscribeToShardEvent Records"},
+			mp.Metrics{Name: keyPrefix + "SubscribeToShardEventMillisBehindLatest", Label: "SubscribeToShardEvent Millis Behind Latest"},
+		},
+	}
+}
+
+// GraphDefinition of KinesisStreamsPlugin
+func (p KinesisStreamsPlugin) GraphDefinition() map[string]mp.Graphs {
+	labelPrefix := strings.Title(p.Prefix)
+	labelPrefix = strings.Replace(labelPrefix, "-", " ", -1)
+
+	multiStream := p.multiStream()
+
+	graphdef := streamMetricGraphs(labelPrefix, multiStream)
+
+	if p.EnableShardMetrics {
+		graphdef["shards"] = shardMetricGraphs(labelPrefix, multiStream)
+	}
+
+	if p.EnableEFOMetrics {
+		graphdef["efo"] = efoMetricGraphs(labelPrefix, multiStream)
+	}
+
 	return graphdef
 }
 
@@ -212,9 +670,17 @@ func main() {
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
 	optRegion := flag.String("region", "", "AWS Region")
-	optIdentifier := flag.String("identifier", "", "Stream Name")
+	optProfile := flag.String("profile", "", "AWS shared credentials profile")
+	optRoleARN := flag.String("role-arn", "", "ARN of an IAM role to assume before calling CloudWatch and Kinesis")
+	optExternalID := flag.String("external-id", "", "External ID to use when assuming -role-arn")
+	optEndpoint := flag.String("endpoint", "", "CloudWatch and Kinesis endpoint URL override (e.g. for LocalStack)")
+	optIdentifier := flag.String("identifier", "", "Stream Name. If omitted, every stream in the region is monitored")
+	optStreamNamePattern := flag.String("stream-name-pattern", "", "Only monitor streams whose name matches this regexp (multi-stream mode only)")
+	optStreamTag := flag.String("stream-tag", "", "Only monitor streams tagged with this key=value pair (multi-stream mode only)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optPrefix := flag.String("metric-key-prefix", "kinesis-streams", "Metric key prefix")
+	optEnableShardMetrics := flag.Bool("enable-shard-metrics", false, "Also fetch per-shard metrics (costs extra CloudWatch and Kinesis API calls)")
+	optEnableEFOMetrics := flag.Bool("enable-efo-metrics", false, "Also fetch per-consumer Enhanced Fan-Out metrics (costs extra CloudWatch and Kinesis API calls)")
 	flag.Parse()
 
 	var plugin KinesisStreamsPlugin
@@ -222,8 +688,16 @@ func main() {
 	plugin.AccessKeyID = *optAccessKeyID
 	plugin.SecretAccessKey = *optSecretAccessKey
 	plugin.Region = *optRegion
+	plugin.Profile = *optProfile
+	plugin.RoleARN = *optRoleARN
+	plugin.ExternalID = *optExternalID
+	plugin.Endpoint = *optEndpoint
 	plugin.Name = *optIdentifier
+	plugin.StreamNamePattern = *optStreamNamePattern
+	plugin.StreamTag = *optStreamTag
 	plugin.Prefix = *optPrefix
+	plugin.EnableShardMetrics = *optEnableShardMetrics
+	plugin.EnableEFOMetrics = *optEnableEFOMetrics
 
 	err := plugin.prepare()
 	if err != nil {
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// fakeMetricsPlugin serves a canned stat map through FetchMetrics so
+// GraphDefinition's wildcard patterns can be checked against OutputValues'
+// real matching logic, without calling out to CloudWatch.
+type fakeMetricsPlugin struct {
+	KinesisStreamsPlugin
+	stat map[string]interface{}
+}
+
+func (f fakeMetricsPlugin) FetchMetrics() (map[string]interface{}, error) {
+	return f.stat, nil
+}
+
+// outputKeys runs stat through the real mp.MackerelPlugin.OutputValues and
+// returns the metric keys it actually emitted, to confirm GraphDefinition's
+// Metrics.Name wildcards line up with the stat map keys FetchMetrics builds.
+func outputKeys(t *testing.T, plugin KinesisStreamsPlugin, stat map[string]interface{}) []string {
+	t.Helper()
+
+	helper := mp.NewMackerelPlugin(fakeMetricsPlugin{KinesisStreamsPlugin: plugin, stat: stat})
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %s", err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	helper.OutputValues()
+	os.Stdout = orig
+	w.Close()
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read captured output: %s", err)
+	}
+
+	var keys []string
+	sc := bufio.NewScanner(strings.NewReader(string(out)))
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) > 0 && fields[0] != "" {
+			keys = append(keys, fields[0])
+		}
+	}
+	return keys
+}
+
+// wantKeys builds the full metric keys OutputValues actually prints: always
+// MetricKeyPrefix() + ".", plus - only for flat, non-wildcarded metrics like
+// the bare stream-level "IncomingBytes" - the graph dict key in between.
+// Wildcarded metrics (shards/efo/multi-stream) print with no dict key, since
+// formatValuesWithWildcard re-dispatches with an empty prefix.
+func wantKeys(prefix string, rawKeys ...string) map[string]bool {
+	want := make(map[string]bool, len(rawKeys))
+	for _, k := range rawKeys {
+		want[prefix+"."+k] = false
+	}
+	return want
+}
+
+func checkKeys(t *testing.T, keys []string, want map[string]bool) {
+	t.Helper()
+	for _, k := range keys {
+		want[k] = true
+	}
+	for k, found := range want {
+		if !found {
+			t.Errorf("expected GraphDefinition to emit %q, got keys %v", k, keys)
+		}
+	}
+}
+
+func TestGraphDefinitionShardMetrics(t *testing.T) {
+	plugin := KinesisStreamsPlugin{Name: "my-stream", EnableShardMetrics: true}
+
+	stat := map[string]interface{}{
+		"IncomingBytes": 1.0,
+		"shards.shardId-000000000000.IncomingBytes":           1.0,
+		"shards.shardId-000000000000.IteratorAgeMilliseconds": 1.0,
+		"shards.shardId-000000000001.IncomingBytes":           1.0,
+	}
+
+	keys := outputKeys(t, plugin, stat)
+
+	prefix := plugin.MetricKeyPrefix()
+	want := wantKeys(prefix,
+		"bytes.IncomingBytes",
+		"shards.shardId-000000000000.IncomingBytes",
+		"shards.shardId-000000000000.IteratorAgeMilliseconds",
+		"shards.shardId-000000000001.IncomingBytes",
+	)
+	checkKeys(t, keys, want)
+}
+
+func TestGraphDefinitionEFOMetrics(t *testing.T) {
+	plugin := KinesisStreamsPlugin{Name: "my-stream", EnableEFOMetrics: true}
+
+	stat := map[string]interface{}{
+		"IncomingBytes": 1.0,
+		"efo.my-consumer.SubscribeToShardSuccess":    1.0,
+		"efo.my-consumer.SubscribeToShardEventBytes": 1.0,
+		"efo.other-consumer.SubscribeToShardSuccess": 1.0,
+	}
+
+	keys := outputKeys(t, plugin, stat)
+
+	prefix := plugin.MetricKeyPrefix()
+	want := wantKeys(prefix,
+		"bytes.IncomingBytes",
+		"efo.my-consumer.SubscribeToShardSuccess",
+		"efo.my-consumer.SubscribeToShardEventBytes",
+		"efo.other-consumer.SubscribeToShardSuccess",
+	)
+	checkKeys(t, keys, want)
+}
+
+func TestGraphDefinitionMultiStreamMetrics(t *testing.T) {
+	// Name left empty selects multi-stream mode.
+	plugin := KinesisStreamsPlugin{EnableShardMetrics: true, EnableEFOMetrics: true}
+
+	stat := map[string]interface{}{
+		"bytes.stream-a.IncomingBytes":                       1.0,
+		"records.stream-a.IncomingRecords":                   1.0,
+		"bytes.stream-b.IncomingBytes":                       1.0,
+		"shards.stream-a.shardId-000000000000.IncomingBytes": 1.0,
+		"efo.stream-a.my-consumer.SubscribeToShardSuccess":   1.0,
+		// buildStreamMetricDataQueries sanitizes dotted stream names
+		// (e.g. "billing.events") into a single path segment.
+		"bytes.billing_events.IncomingBytes": 1.0,
+	}
+
+	keys := outputKeys(t, plugin, stat)
+
+	prefix := plugin.MetricKeyPrefix()
+	want := wantKeys(prefix,
+		"bytes.stream-a.IncomingBytes",
+		"records.stream-a.IncomingRecords",
+		"bytes.stream-b.IncomingBytes",
+		"shards.stream-a.shardId-000000000000.IncomingBytes",
+		"efo.stream-a.my-consumer.SubscribeToShardSuccess",
+		"bytes.billing_events.IncomingBytes",
+	)
+	checkKeys(t, keys, want)
+}
+
+func TestSanitizeMetricKeySegment(t *testing.T) {
+	cases := map[string]string{
+		"my-consumer":    "my-consumer",
+		"billing.events": "billing_events",
+		"a.b.c":          "a_b_c",
+	}
+	for in, want := range cases {
+		if got := sanitizeMetricKeySegment(in); got != want {
+			t.Errorf("sanitizeMetricKeySegment(%q) = %q, want %q", in, got, want)
+		}
+	}
+}